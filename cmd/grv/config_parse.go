@@ -5,6 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
 type commandConstructor func(*ConfigParser, []*ConfigToken) (ConfigCommand, error)
@@ -89,34 +92,140 @@ func (quitCommand *QuitCommand) Equal(command ConfigCommand) bool {
 	return ok
 }
 
+// ExecCommand contains state for executing an external command or script
+type ExecCommand struct {
+	command *ConfigToken
+}
+
+// Equal returns true if the provided command is equal
+func (execCommand *ExecCommand) Equal(command ConfigCommand) bool {
+	other, ok := command.(*ExecCommand)
+	if !ok {
+		return false
+	}
+
+	return (execCommand.command != nil && execCommand.command.Equal(other.command)) ||
+		(execCommand.command == nil && other.command == nil)
+}
+
+// SourceCommand contains state for sourcing another config file
+type SourceCommand struct {
+	path *ConfigToken
+}
+
+// Equal returns true if the provided command is equal
+func (sourceCommand *SourceCommand) Equal(command ConfigCommand) bool {
+	other, ok := command.(*SourceCommand)
+	if !ok {
+		return false
+	}
+
+	return (sourceCommand.path != nil && sourceCommand.path.Equal(other.path)) ||
+		(sourceCommand.path == nil && other.path == nil)
+}
+
+// DefCommand contains state for a user defined command made up of a
+// sequence of other ConfigCommands
+type DefCommand struct {
+	name *ConfigToken
+	body []ConfigCommand
+}
+
+// Equal returns true if the provided command is equal
+func (defCommand *DefCommand) Equal(command ConfigCommand) bool {
+	other, ok := command.(*DefCommand)
+	if !ok {
+		return false
+	}
+
+	if !((defCommand.name != nil && defCommand.name.Equal(other.name)) ||
+		(defCommand.name == nil && other.name == nil)) {
+		return false
+	}
+
+	if len(defCommand.body) != len(other.body) {
+		return false
+	}
+
+	for i, bodyCommand := range defCommand.body {
+		if !bodyCommand.Equal(other.body[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
 type commandDescriptor struct {
 	tokenTypes  []ConfigTokenType
 	constructor commandConstructor
 }
 
-var commandDescriptors = map[string]*commandDescriptor{
-	"set": {
-		tokenTypes:  []ConfigTokenType{CtkWord, CtkWord},
-		constructor: setCommandConstructor,
-	},
-	"theme": {
-		tokenTypes:  []ConfigTokenType{CtkOption, CtkWord, CtkOption, CtkWord, CtkOption, CtkWord, CtkOption, CtkWord},
-		constructor: themeCommandConstructor,
-	},
-	"map": {
-		tokenTypes:  []ConfigTokenType{CtkWord, CtkWord, CtkWord},
-		constructor: mapCommandConstructor,
-	},
-	"q": {
+// newCommandDescriptors builds the table of top level config commands.
+// This is constructed fresh per ConfigParser, rather than held in a
+// package level var, because "def" registers defCommandConstructor here,
+// and defCommandConstructor transitively calls back into parseCommand's
+// lookup of this same table: a package level var with that reference
+// would be an initialization cycle.
+func newCommandDescriptors() map[string]*commandDescriptor {
+	// execDescriptor is shared by the "exec" command and its "!" alias.
+	// The shell command is free-form and may contain multiple unquoted
+	// words (e.g. "!git blame %f"), so unlike the other commands it is
+	// not described by a fixed sequence of token types;
+	// execCommandConstructor reads the remainder of the line itself
+	execDescriptor := &commandDescriptor{
 		tokenTypes:  []ConfigTokenType{},
-		constructor: quitCommandConstructor,
-	},
+		constructor: execCommandConstructor,
+	}
+
+	return map[string]*commandDescriptor{
+		"set": {
+			tokenTypes:  []ConfigTokenType{CtkWord, CtkWord},
+			constructor: setCommandConstructor,
+		},
+		"theme": {
+			tokenTypes:  []ConfigTokenType{CtkOption, CtkWord, CtkOption, CtkWord, CtkOption, CtkWord, CtkOption, CtkWord},
+			constructor: themeCommandConstructor,
+		},
+		"map": {
+			tokenTypes:  []ConfigTokenType{CtkWord, CtkWord, CtkWord},
+			constructor: mapCommandConstructor,
+		},
+		"q": {
+			tokenTypes:  []ConfigTokenType{},
+			constructor: quitCommandConstructor,
+		},
+		"exec": execDescriptor,
+		"!":    execDescriptor,
+		"source": {
+			tokenTypes:  []ConfigTokenType{CtkWord},
+			constructor: sourceCommandConstructor,
+		},
+		"def": {
+			tokenTypes:  []ConfigTokenType{CtkWord},
+			constructor: defCommandConstructor,
+		},
+	}
 }
 
-// ConfigParser is a component capable of parsing config into commands
-type ConfigParser struct {
+// configParserSource holds the state required to resume parsing the
+// outer config file once a sourced file has been fully consumed
+type configParserSource struct {
 	scanner     *ConfigScanner
 	inputSource string
+	branchDepth int
+}
+
+// ConfigParser is a component capable of parsing config into commands
+type ConfigParser struct {
+	scanner         *ConfigScanner
+	inputSource     string
+	sourceStack     []*configParserSource
+	sourcedPaths    map[string]bool
+	branchStack     []*conditionalBranch
+	userCommands    map[string][]ConfigCommand
+	pendingCommands []ConfigCommand
+	descriptors     map[string]*commandDescriptor
 }
 
 // NewConfigParser creates a new ConfigParser which will read input from the provided reader
@@ -124,6 +233,7 @@ func NewConfigParser(reader io.Reader, inputSource string) *ConfigParser {
 	return &ConfigParser{
 		scanner:     NewConfigScanner(reader),
 		inputSource: inputSource,
+		descriptors: newCommandDescriptors(),
 	}
 }
 
@@ -132,18 +242,49 @@ func NewConfigParser(reader io.Reader, inputSource string) *ConfigParser {
 func (parser *ConfigParser) Parse() (command ConfigCommand, eof bool, err error) {
 	var token *ConfigToken
 
+	if len(parser.pendingCommands) > 0 {
+		command = parser.pendingCommands[0]
+		parser.pendingCommands = parser.pendingCommands[1:]
+		return
+	}
+
 	for {
 		token, err = parser.scan()
 		if err != nil {
 			return
 		}
 
+		if token.tokenType == CtkWord {
+			var handled bool
+			handled, err = parser.handleConditionalDirective(token)
+			if err != nil {
+				break
+			}
+
+			if handled {
+				continue
+			}
+
+			if !parser.branchActive() {
+				parser.discardTokensUntilNextCommand()
+				continue
+			}
+		}
+
 		switch token.tokenType {
 		case CtkWord:
 			command, eof, err = parser.parseCommand(token)
 		case CtkTerminator:
 			continue
 		case CtkEOF:
+			if depthErr := parser.checkBranchDepthAtEOF(); depthErr != nil {
+				err = parser.generateParseError(token, "%v", depthErr)
+				break
+			}
+
+			if parser.popSource() {
+				continue
+			}
 			eof = true
 		case CtkOption:
 			err = parser.generateParseError(token, "Unexpected Option \"%v\"", token.value)
@@ -153,6 +294,17 @@ func (parser *ConfigParser) Parse() (command ConfigCommand, eof bool, err error)
 			err = parser.generateParseError(token, "Unexpected token \"%v\"", token.value)
 		}
 
+		if err == nil {
+			if _, isSourceCommand := command.(*SourceCommand); isSourceCommand {
+				command = nil
+				continue
+			}
+
+			if command == nil && !eof {
+				continue
+			}
+		}
+
 		break
 	}
 
@@ -163,6 +315,95 @@ func (parser *ConfigParser) Parse() (command ConfigCommand, eof bool, err error)
 	return
 }
 
+// resolveSourcePath resolves path relative to the directory of the file
+// that is sourcing it (basePath), so that "source themes.grvrc" works
+// regardless of the directory grv was launched from. Absolute paths are
+// left as is. The result is cleaned so that equivalent spellings of the
+// same file (e.g. "./a.grvrc" and "a.grvrc") resolve identically
+func resolveSourcePath(basePath, path string) string {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+
+	return filepath.Clean(filepath.Join(filepath.Dir(basePath), path))
+}
+
+// pushSource opens the file at path and makes it the current input for
+// the parser, saving the existing scanner and input source so parsing
+// of the outer file can resume once the sourced file is exhausted
+func (parser *ConfigParser) pushSource(path string) error {
+	resolvedPath := resolveSourcePath(parser.inputSource, path)
+
+	if parser.sourcedPaths == nil {
+		// The top level file is an ancestor of every sourced file
+		parser.sourcedPaths = map[string]bool{filepath.Clean(parser.inputSource): true}
+	}
+
+	if parser.sourcedPaths[resolvedPath] {
+		return fmt.Errorf("Cyclic source detected: \"%v\" has already been sourced", resolvedPath)
+	}
+
+	file, err := os.Open(resolvedPath)
+	if err != nil {
+		return fmt.Errorf("Unable to source \"%v\": %v", resolvedPath, err)
+	}
+
+	parser.sourcedPaths[resolvedPath] = true
+
+	parser.sourceStack = append(parser.sourceStack, &configParserSource{
+		scanner:     parser.scanner,
+		inputSource: parser.inputSource,
+		branchDepth: len(parser.branchStack),
+	})
+
+	parser.scanner = NewConfigScanner(file)
+	parser.inputSource = resolvedPath
+
+	return nil
+}
+
+// checkBranchDepthAtEOF returns an error if an if block opened in the
+// current file (or sourced file) has not been closed with a matching
+// endif by the time its end is reached. Without this an unterminated if
+// in a sourced file would leak its open branch onto the including file,
+// silently discarding or misinterpreting everything that follows it
+func (parser *ConfigParser) checkBranchDepthAtEOF() error {
+	var expectedDepth int
+	if len(parser.sourceStack) > 0 {
+		expectedDepth = parser.sourceStack[len(parser.sourceStack)-1].branchDepth
+	}
+
+	if len(parser.branchStack) != expectedDepth {
+		return errors.New("Missing \"endif\" before end of input")
+	}
+
+	return nil
+}
+
+// popSource restores the scanner and input source that were active
+// before the most recently sourced file was pushed. It returns false if
+// there is no outer source to resume
+func (parser *ConfigParser) popSource() bool {
+	if len(parser.sourceStack) == 0 {
+		return false
+	}
+
+	lastIndex := len(parser.sourceStack) - 1
+	source := parser.sourceStack[lastIndex]
+	parser.sourceStack = parser.sourceStack[:lastIndex]
+
+	// The file being left is no longer on the active source chain, so it
+	// may legitimately be sourced again from a sibling branch (a diamond
+	// include). Only a file that is still an ancestor of the current
+	// position is a cycle
+	delete(parser.sourcedPaths, parser.inputSource)
+
+	parser.scanner = source.scanner
+	parser.inputSource = source.inputSource
+
+	return true
+}
+
 // InputSource returns the text description of the input source
 func (parser *ConfigParser) InputSource() string {
 	return parser.inputSource
@@ -180,6 +421,10 @@ func (parser *ConfigParser) scan() (token *ConfigToken, err error) {
 		}
 	}
 
+	if err == nil {
+		token = expandConfigToken(token)
+	}
+
 	return
 }
 
@@ -219,8 +464,12 @@ func (parser *ConfigParser) discardTokensUntilNextCommand() {
 }
 
 func (parser *ConfigParser) parseCommand(token *ConfigToken) (command ConfigCommand, eof bool, err error) {
-	commandDescriptor, ok := commandDescriptors[token.value]
+	commandDescriptor, ok := parser.descriptors[token.value]
 	if !ok {
+		if body, isUserCommand := parser.userCommands[token.value]; isUserCommand {
+			return parser.invokeUserCommand(token, body)
+		}
+
 		err = parser.generateParseError(token, "Invalid command \"%v\"", token.value)
 		return
 	}
@@ -298,3 +547,53 @@ func mapCommandConstructor(parser *ConfigParser, tokens []*ConfigToken) (ConfigC
 func quitCommandConstructor(parser *ConfigParser, tokens []*ConfigToken) (ConfigCommand, error) {
 	return &QuitCommand{}, nil
 }
+
+func execCommandConstructor(parser *ConfigParser, tokens []*ConfigToken) (ConfigCommand, error) {
+	firstToken, err := parser.scan()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case firstToken.err != nil || firstToken.tokenType == CtkInvalid:
+		return nil, parser.generateParseError(firstToken, "Syntax Error")
+	case firstToken.tokenType == CtkTerminator || firstToken.tokenType == CtkEOF:
+		return nil, parser.generateParseError(firstToken, "Expected a command to execute")
+	}
+
+	words := []string{firstToken.value}
+
+	for {
+		token, err := parser.scan()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case token.err != nil || token.tokenType == CtkInvalid:
+			return nil, parser.generateParseError(token, "Syntax Error")
+		case token.tokenType == CtkTerminator || token.tokenType == CtkEOF:
+			return &ExecCommand{
+				command: &ConfigToken{
+					tokenType: CtkWord,
+					value:     strings.Join(words, " "),
+					startPos:  firstToken.startPos,
+				},
+			}, nil
+		}
+
+		words = append(words, token.value)
+	}
+}
+
+func sourceCommandConstructor(parser *ConfigParser, tokens []*ConfigToken) (ConfigCommand, error) {
+	pathToken := tokens[0]
+
+	if err := parser.pushSource(pathToken.value); err != nil {
+		return nil, parser.generateParseError(pathToken, "%v", err)
+	}
+
+	return &SourceCommand{
+		path: pathToken,
+	}, nil
+}
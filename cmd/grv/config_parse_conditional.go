@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// conditionalBranch tracks the state of a single if/elseif/else/endif block
+type conditionalBranch struct {
+	// taken is true once this block (or an earlier elseif/else sibling) has matched
+	taken bool
+	// active is true if this branch is currently selected for evaluation
+	active bool
+	// parentActive is true if the block enclosing this one is active
+	parentActive bool
+}
+
+// branchActive returns true if every enclosing if/elseif/else block is
+// currently active, meaning commands should be parsed rather than discarded
+func (parser *ConfigParser) branchActive() bool {
+	if len(parser.branchStack) == 0 {
+		return true
+	}
+
+	return parser.branchStack[len(parser.branchStack)-1].active
+}
+
+// handleConditionalDirective processes if/elseif/else/endif keywords.
+// handled is true if token was a conditional directive, in which case it
+// has already been fully consumed and produces no ConfigCommand
+func (parser *ConfigParser) handleConditionalDirective(token *ConfigToken) (handled bool, err error) {
+	switch token.value {
+	case "if":
+		handled = true
+		err = parser.pushConditionalBranch(token)
+	case "elseif":
+		handled = true
+		err = parser.nextConditionalBranch(token, true)
+	case "else":
+		handled = true
+		err = parser.nextConditionalBranch(token, false)
+	case "endif":
+		handled = true
+		err = parser.popConditionalBranch(token)
+	}
+
+	return
+}
+
+func (parser *ConfigParser) pushConditionalBranch(token *ConfigToken) error {
+	parentActive := parser.branchActive()
+
+	condition, err := parser.parseCondition()
+	if err != nil {
+		return parser.generateParseError(token, "%v", err)
+	}
+
+	active := parentActive && condition
+
+	parser.branchStack = append(parser.branchStack, &conditionalBranch{
+		taken:        active,
+		active:       active,
+		parentActive: parentActive,
+	})
+
+	return nil
+}
+
+func (parser *ConfigParser) nextConditionalBranch(token *ConfigToken, hasCondition bool) error {
+	if len(parser.branchStack) == 0 {
+		return parser.generateParseError(token, "\"%v\" has no matching if", token.value)
+	}
+
+	branch := parser.branchStack[len(parser.branchStack)-1]
+
+	var condition bool
+	if hasCondition {
+		var err error
+		if condition, err = parser.parseCondition(); err != nil {
+			return parser.generateParseError(token, "%v", err)
+		}
+	} else {
+		if err := parser.expectTerminator(); err != nil {
+			return err
+		}
+		condition = true
+	}
+
+	switch {
+	case branch.taken:
+		branch.active = false
+	default:
+		branch.active = branch.parentActive && condition
+		branch.taken = branch.active
+	}
+
+	return nil
+}
+
+func (parser *ConfigParser) popConditionalBranch(token *ConfigToken) error {
+	if len(parser.branchStack) == 0 {
+		return parser.generateParseError(token, "\"endif\" has no matching if")
+	}
+
+	if err := parser.expectTerminator(); err != nil {
+		return err
+	}
+
+	parser.branchStack = parser.branchStack[:len(parser.branchStack)-1]
+
+	return nil
+}
+
+func (parser *ConfigParser) expectTerminator() error {
+	token, err := parser.scan()
+	if err != nil {
+		return err
+	}
+
+	if token.tokenType != CtkTerminator && token.tokenType != CtkEOF {
+		return parser.generateParseError(token, "Unexpected token \"%v\"", token.value)
+	}
+
+	return nil
+}
+
+// parseCondition reads and evaluates the remainder of an if/elseif line.
+// Supported forms are:
+//
+//	if env <VARIABLE> == "value"
+//	if has_color <colors>
+//	if version >= "x.y.z"
+func (parser *ConfigParser) parseCondition() (result bool, err error) {
+	var tokens []*ConfigToken
+
+	for {
+		var token *ConfigToken
+		if token, err = parser.scan(); err != nil {
+			return
+		}
+
+		if token.tokenType == CtkTerminator || token.tokenType == CtkEOF {
+			break
+		}
+
+		tokens = append(tokens, token)
+	}
+
+	if len(tokens) == 0 {
+		err = errors.New("Expected condition")
+		return
+	}
+
+	switch tokens[0].value {
+	case "env":
+		if len(tokens) != 4 || tokens[2].value != "==" {
+			err = errors.New("Expected: env <variable> == \"value\"")
+			return
+		}
+
+		result = os.Getenv(tokens[1].value) == tokens[3].value
+	case "has_color":
+		if len(tokens) != 2 {
+			err = errors.New("Expected: has_color <colors>")
+			return
+		}
+
+		var colors int
+		if colors, err = strconv.Atoi(tokens[1].value); err != nil {
+			err = fmt.Errorf("Invalid color count \"%v\"", tokens[1].value)
+			return
+		}
+
+		result = colors <= terminalColorCount()
+	case "version":
+		if len(tokens) != 3 {
+			err = errors.New("Expected: version <operator> \"version\"")
+			return
+		}
+
+		result, err = evaluateVersionCondition(tokens[1].value, tokens[2].value)
+	default:
+		err = fmt.Errorf("Unknown condition \"%v\"", tokens[0].value)
+	}
+
+	return
+}
+
+// terminalColorCount returns the number of colors the running terminal is
+// assumed to support, as used by the config parser's "has_color"
+// condition. It always returns 256: the count is not read from terminfo or
+// from the terminal, so "has_color" is true for any count up to 256
+var terminalColorCount = func() int {
+	return 256
+}
+
+// grvVersion is the version string "version" conditions are compared against
+var grvVersion = "0.3"
+
+func evaluateVersionCondition(operator, version string) (bool, error) {
+	result := compareVersions(grvVersion, version)
+
+	switch operator {
+	case "==":
+		return result == 0, nil
+	case "!=":
+		return result != 0, nil
+	case ">":
+		return result > 0, nil
+	case ">=":
+		return result >= 0, nil
+	case "<":
+		return result < 0, nil
+	case "<=":
+		return result <= 0, nil
+	default:
+		return false, fmt.Errorf("Unknown version operator \"%v\"", operator)
+	}
+}
+
+// compareVersions compares two dotted version strings, returning a
+// negative number if v1 < v2, zero if v1 == v2 and a positive number if
+// v1 > v2
+func compareVersions(v1, v2 string) int {
+	parts1 := strings.Split(v1, ".")
+	parts2 := strings.Split(v2, ".")
+
+	for i := 0; i < len(parts1) || i < len(parts2); i++ {
+		var n1, n2 int
+
+		if i < len(parts1) {
+			n1, _ = strconv.Atoi(parts1[i])
+		}
+		if i < len(parts2) {
+			n2, _ = strconv.Atoi(parts2[i])
+		}
+
+		if n1 != n2 {
+			return n1 - n2
+		}
+	}
+
+	return 0
+}
+
+var (
+	envVarExpansionPattern   = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+	cmdSubstExpansionPattern = regexp.MustCompile(`\$\(([^)]*)\)`)
+)
+
+// expandConfigToken performs ${VAR} environment variable expansion and
+// $(cmd) command substitution on a CtkWord token's value
+func expandConfigToken(token *ConfigToken) *ConfigToken {
+	if token.tokenType != CtkWord || !strings.ContainsRune(token.value, '$') {
+		return token
+	}
+
+	expanded := *token
+	expanded.value = expandVariables(expandCommands(token.value))
+
+	return &expanded
+}
+
+func expandVariables(value string) string {
+	return envVarExpansionPattern.ReplaceAllStringFunc(value, func(match string) string {
+		name := envVarExpansionPattern.FindStringSubmatch(match)[1]
+		return os.Getenv(name)
+	})
+}
+
+func expandCommands(value string) string {
+	return cmdSubstExpansionPattern.ReplaceAllStringFunc(value, func(match string) string {
+		command := cmdSubstExpansionPattern.FindStringSubmatch(match)[1]
+
+		output, err := exec.Command("sh", "-c", command).Output()
+		if err != nil {
+			return ""
+		}
+
+		return strings.TrimRight(string(output), "\n")
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+// defCommandConstructor collects the commands between "def <name>" and the
+// closing "enddef" and registers them against name, so that subsequent
+// config commands may invoke name to run the whole sequence
+func defCommandConstructor(parser *ConfigParser, tokens []*ConfigToken) (ConfigCommand, error) {
+	nameToken := tokens[0]
+
+	body, err := parser.collectDefBody(nameToken.value)
+	if err != nil {
+		return nil, err
+	}
+
+	if parser.userCommands == nil {
+		parser.userCommands = make(map[string][]ConfigCommand)
+	}
+
+	parser.userCommands[nameToken.value] = body
+
+	return &DefCommand{
+		name: nameToken,
+		body: body,
+	}, nil
+}
+
+// collectDefBody parses commands until a terminating "enddef" is reached.
+// name is the command currently being defined; a reference to it within
+// its own body is rejected as recursive. "source" is rejected outright,
+// since switching the parser's active input source part way through
+// collecting a def body would leave enddef being looked for in the wrong
+// file
+func (parser *ConfigParser) collectDefBody(name string) (body []ConfigCommand, err error) {
+	branchBaseline := len(parser.branchStack)
+
+	for {
+		var token *ConfigToken
+		if token, err = parser.scan(); err != nil {
+			return
+		}
+
+		switch token.tokenType {
+		case CtkTerminator:
+			continue
+		case CtkEOF:
+			err = parser.generateParseError(token, "Unexpected EOF, expected \"enddef\"")
+			return
+		case CtkWord:
+			if token.value == "enddef" {
+				if len(parser.branchStack) != branchBaseline {
+					err = parser.generateParseError(token, "Missing \"endif\" in definition of \"%v\"", name)
+					return
+				}
+
+				err = parser.expectTerminator()
+				return
+			}
+
+			if token.value == name {
+				err = parser.generateParseError(token, "\"%v\" cannot be referenced within its own definition", name)
+				return
+			}
+
+			if token.value == "source" {
+				err = parser.generateParseError(token, "\"source\" is not permitted inside a \"def\" body")
+				return
+			}
+
+			var handled bool
+			if handled, err = parser.handleConditionalDirective(token); err != nil {
+				return
+			} else if handled {
+				continue
+			}
+
+			if !parser.branchActive() {
+				parser.discardTokensUntilNextCommand()
+				continue
+			}
+
+			if existingBody, isUserCommand := parser.userCommands[token.value]; isUserCommand {
+				body = append(body, existingBody...)
+				continue
+			}
+
+			var command ConfigCommand
+			if command, _, err = parser.parseCommand(token); err != nil {
+				return
+			}
+
+			if command != nil {
+				body = append(body, command)
+			}
+		default:
+			err = parser.generateParseError(token, "Unexpected token \"%v\"", token.value)
+			return
+		}
+	}
+}
+
+// invokeUserCommand expands a user defined command into its constituent
+// ConfigCommands. The first is returned immediately and any remaining
+// commands are queued so subsequent calls to Parse return them in order
+func (parser *ConfigParser) invokeUserCommand(token *ConfigToken, body []ConfigCommand) (command ConfigCommand, eof bool, err error) {
+	if len(body) == 0 {
+		return
+	}
+
+	command = body[0]
+	parser.pendingCommands = append(parser.pendingCommands, body[1:]...)
+
+	return
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSourceResolvesPathRelativeToIncludingFile(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatalf("Failed to create sub directory: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "sub", "b.grvrc"), []byte("set core.editor vim\n"), 0644); err != nil {
+		t.Fatalf("Failed to write sourced file: %v", err)
+	}
+
+	mainPath := filepath.Join(dir, "a.grvrc")
+	if err := os.WriteFile(mainPath, []byte("source sub/b.grvrc\n"), 0644); err != nil {
+		t.Fatalf("Failed to write main file: %v", err)
+	}
+
+	file, err := os.Open(mainPath)
+	if err != nil {
+		t.Fatalf("Failed to open main file: %v", err)
+	}
+	defer file.Close()
+
+	parser := NewConfigParser(file, mainPath)
+
+	command, eof, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("Parse failed with error %v", err)
+	}
+	if eof {
+		t.Fatalf("Unexpected eof")
+	}
+
+	expected := &SetCommand{
+		variable: newConfigWordToken("core.editor"),
+		value:    newConfigWordToken("vim"),
+	}
+
+	if !command.Equal(expected) {
+		t.Errorf("Expected %v but got %v", expected, command)
+	}
+}
+
+func TestSourceAllowsNonCyclicDiamondInclude(t *testing.T) {
+	dir := t.TempDir()
+
+	common := filepath.Join(dir, "common.grvrc")
+	if err := os.WriteFile(common, []byte("set core.editor vim\n"), 0644); err != nil {
+		t.Fatalf("Failed to write common file: %v", err)
+	}
+
+	left := filepath.Join(dir, "left.grvrc")
+	if err := os.WriteFile(left, []byte("source common.grvrc\n"), 0644); err != nil {
+		t.Fatalf("Failed to write left file: %v", err)
+	}
+
+	mainPath := filepath.Join(dir, "main.grvrc")
+	mainContents := "source left.grvrc\nsource common.grvrc\n"
+	if err := os.WriteFile(mainPath, []byte(mainContents), 0644); err != nil {
+		t.Fatalf("Failed to write main file: %v", err)
+	}
+
+	file, err := os.Open(mainPath)
+	if err != nil {
+		t.Fatalf("Failed to open main file: %v", err)
+	}
+	defer file.Close()
+
+	parser := NewConfigParser(file, mainPath)
+
+	for i := 0; i < 2; i++ {
+		_, eof, err := parser.Parse()
+		if err != nil {
+			t.Fatalf("Expected diamond include of the same file via different branches to succeed, but got error: %v", err)
+		}
+		if eof {
+			t.Fatalf("Unexpected eof")
+		}
+	}
+}
+
+func TestSourceDetectsRealCycle(t *testing.T) {
+	dir := t.TempDir()
+
+	aPath := filepath.Join(dir, "a.grvrc")
+	bPath := filepath.Join(dir, "b.grvrc")
+
+	if err := os.WriteFile(aPath, []byte("source b.grvrc\n"), 0644); err != nil {
+		t.Fatalf("Failed to write a.grvrc: %v", err)
+	}
+	if err := os.WriteFile(bPath, []byte("source a.grvrc\n"), 0644); err != nil {
+		t.Fatalf("Failed to write b.grvrc: %v", err)
+	}
+
+	file, err := os.Open(aPath)
+	if err != nil {
+		t.Fatalf("Failed to open a.grvrc: %v", err)
+	}
+	defer file.Close()
+
+	parser := NewConfigParser(file, aPath)
+
+	var sawError bool
+	for i := 0; i < 10; i++ {
+		_, eof, err := parser.Parse()
+		if err != nil {
+			sawError = true
+			break
+		}
+		if eof {
+			break
+		}
+	}
+
+	if !sawError {
+		t.Errorf("Expected a cyclic source error")
+	}
+}
+
+func TestSourceWithUnterminatedIfIsRejected(t *testing.T) {
+	sourcedPath := filepath.Join(t.TempDir(), "sourced.grvrc")
+
+	if err := os.WriteFile(sourcedPath, []byte("if env TERM == \"xterm\"\nset core.editor vim\n"), 0644); err != nil {
+		t.Fatalf("Failed to write sourced file: %v", err)
+	}
+
+	input := "source " + sourcedPath + "\nq\n"
+
+	parser := NewConfigParser(strings.NewReader(input), "test")
+
+	var sawError bool
+	for i := 0; i < 10; i++ {
+		_, eof, err := parser.Parse()
+		if err != nil {
+			sawError = true
+			break
+		}
+		if eof {
+			break
+		}
+	}
+
+	if !sawError {
+		t.Errorf("Expected an error for an if block left open across a sourced file boundary")
+	}
+}
+
+func TestDefBodyWithUnterminatedIfIsRejected(t *testing.T) {
+	input := "def greet\nif env TERM == \"xterm\"\nset core.editor vim\nenddef\n"
+
+	parser := NewConfigParser(strings.NewReader(input), "test")
+
+	if _, _, err := parser.Parse(); err == nil {
+		t.Errorf("Expected an error for an if block left open inside a def body")
+	}
+}
+
+func TestIfElseifElseSelectsMatchingBranch(t *testing.T) {
+	input := "if env NO_SUCH_GRV_TEST_VAR == \"unused\"\n" +
+		"set should_be_skipped yes\n" +
+		"elseif env NO_SUCH_GRV_TEST_VAR == \"\"\n" +
+		"set should_be_set yes\n" +
+		"else\n" +
+		"set should_also_be_skipped yes\n" +
+		"endif\n"
+
+	parser := NewConfigParser(strings.NewReader(input), "test")
+
+	command, eof, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("Parse failed with error %v", err)
+	}
+	if eof {
+		t.Fatalf("Unexpected eof")
+	}
+
+	expected := &SetCommand{
+		variable: newConfigWordToken("should_be_set"),
+		value:    newConfigWordToken("yes"),
+	}
+
+	if !command.Equal(expected) {
+		t.Errorf("Expected %v but got %v", expected, command)
+	}
+
+	if _, eof, err := parser.Parse(); err != nil {
+		t.Fatalf("Parse failed with error %v", err)
+	} else if !eof {
+		t.Errorf("Expected no further commands from the unselected branches")
+	}
+}
+
+func TestIfWithFalseConditionDiscardsBody(t *testing.T) {
+	input := "if env NO_SUCH_GRV_TEST_VAR == \"unused\"\n" +
+		"set should_be_skipped yes\n" +
+		"endif\n" +
+		"set always_here yes\n"
+
+	parser := NewConfigParser(strings.NewReader(input), "test")
+
+	command, eof, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("Parse failed with error %v", err)
+	}
+	if eof {
+		t.Fatalf("Unexpected eof")
+	}
+
+	expected := &SetCommand{
+		variable: newConfigWordToken("always_here"),
+		value:    newConfigWordToken("yes"),
+	}
+
+	if !command.Equal(expected) {
+		t.Errorf("Expected %v but got %v", expected, command)
+	}
+}
+
+func TestDefBodyDiscardsCommandsInInactiveBranch(t *testing.T) {
+	input := "def greet\n" +
+		"if env NO_SUCH_GRV_TEST_VAR == \"unused\"\n" +
+		"set should_be_skipped yes\n" +
+		"endif\n" +
+		"set always_here yes\n" +
+		"enddef\n"
+
+	parser := NewConfigParser(strings.NewReader(input), "test")
+
+	if _, _, err := parser.Parse(); err != nil {
+		t.Fatalf("Parse failed with error %v", err)
+	}
+
+	body, ok := parser.userCommands["greet"]
+	if !ok {
+		t.Fatalf("Expected \"greet\" to be a registered user command")
+	}
+
+	expectedBody := []ConfigCommand{
+		&SetCommand{variable: newConfigWordToken("always_here"), value: newConfigWordToken("yes")},
+	}
+
+	if len(body) != len(expectedBody) {
+		t.Fatalf("Expected def body %v but got %v", expectedBody, body)
+	}
+
+	for i, expected := range expectedBody {
+		if !body[i].Equal(expected) {
+			t.Errorf("Command %v of def body: expected %v but got %v", i, expected, body[i])
+		}
+	}
+}
+
+func TestEnvVarExpansion(t *testing.T) {
+	if err := os.Setenv("GRV_TEST_EXPANSION_VAR", "expanded-value"); err != nil {
+		t.Fatalf("Failed to set environment variable: %v", err)
+	}
+	defer os.Unsetenv("GRV_TEST_EXPANSION_VAR")
+
+	input := "set core.editor ${GRV_TEST_EXPANSION_VAR}\n"
+
+	parser := NewConfigParser(strings.NewReader(input), "test")
+
+	command, eof, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("Parse failed with error %v", err)
+	}
+	if eof {
+		t.Fatalf("Unexpected eof")
+	}
+
+	expected := &SetCommand{
+		variable: newConfigWordToken("core.editor"),
+		value:    newConfigWordToken("expanded-value"),
+	}
+
+	if !command.Equal(expected) {
+		t.Errorf("Expected %v but got %v", expected, command)
+	}
+}
+
+func TestCommandSubstitutionExpansion(t *testing.T) {
+	input := "set core.editor $(echo substituted-value)\n"
+
+	parser := NewConfigParser(strings.NewReader(input), "test")
+
+	command, eof, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("Parse failed with error %v", err)
+	}
+	if eof {
+		t.Fatalf("Unexpected eof")
+	}
+
+	expected := &SetCommand{
+		variable: newConfigWordToken("core.editor"),
+		value:    newConfigWordToken("substituted-value"),
+	}
+
+	if !command.Equal(expected) {
+		t.Errorf("Expected %v but got %v", expected, command)
+	}
+}
+
+func TestDefBodyRejectsSource(t *testing.T) {
+	input := "def greet\nsource other.grvrc\nenddef\n"
+
+	parser := NewConfigParser(strings.NewReader(input), "test")
+
+	if _, _, err := parser.Parse(); err == nil {
+		t.Errorf("Expected an error for \"source\" used inside a def body")
+	}
+}
+
+func TestExecCommandParsesMultiWordShellCommand(t *testing.T) {
+	input := "!git blame %f\n"
+
+	parser := NewConfigParser(strings.NewReader(input), "test")
+
+	command, eof, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("Parse failed with error %v", err)
+	}
+	if eof {
+		t.Fatalf("Unexpected eof")
+	}
+
+	expected := &ExecCommand{
+		command: newConfigWordToken("git blame %f"),
+	}
+
+	if !command.Equal(expected) {
+		t.Errorf("Expected %v but got %v", expected, command)
+	}
+}
+
+func TestTomlConfigParserSupportsMultipleThemeComponents(t *testing.T) {
+	input := `
+[[theme.custom]]
+component = "CommitAuthor"
+bgcolor = "blue"
+fgcolor = "none"
+
+[[theme.custom]]
+component = "CommitDate"
+bgcolor = "green"
+fgcolor = "none"
+`
+
+	parser := NewTomlConfigParser(strings.NewReader(input), "test.toml")
+
+	expected := []ConfigCommand{
+		&ThemeCommand{
+			name:      newConfigWordToken("custom"),
+			component: newConfigWordToken("CommitAuthor"),
+			bgcolor:   newConfigWordToken("blue"),
+			fgcolor:   newConfigWordToken("none"),
+		},
+		&ThemeCommand{
+			name:      newConfigWordToken("custom"),
+			component: newConfigWordToken("CommitDate"),
+			bgcolor:   newConfigWordToken("green"),
+			fgcolor:   newConfigWordToken("none"),
+		},
+	}
+
+	for i, want := range expected {
+		command, eof, err := parser.Parse()
+		if err != nil {
+			t.Fatalf("Parse failed with error %v", err)
+		}
+		if eof {
+			t.Fatalf("Unexpected eof before reading all expected commands")
+		}
+		if !command.Equal(want) {
+			t.Errorf("Command %v: expected %v but got %v", i, want, command)
+		}
+	}
+}
+
+func TestDefCommandInlinesReferencedUserCommand(t *testing.T) {
+	input := `def greet
+set core.editor vim
+set core.pager less
+enddef
+def wrapper
+greet
+q
+enddef
+`
+
+	parser := NewConfigParser(strings.NewReader(input), "test")
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := parser.Parse(); err != nil {
+			t.Fatalf("Parse failed with error %v", err)
+		}
+	}
+
+	wrapperBody, ok := parser.userCommands["wrapper"]
+	if !ok {
+		t.Fatalf("Expected \"wrapper\" to be a registered user command")
+	}
+
+	expectedBody := []ConfigCommand{
+		&SetCommand{variable: newConfigWordToken("core.editor"), value: newConfigWordToken("vim")},
+		&SetCommand{variable: newConfigWordToken("core.pager"), value: newConfigWordToken("less")},
+		&QuitCommand{},
+	}
+
+	if len(wrapperBody) != len(expectedBody) {
+		t.Fatalf("Expected wrapper body %v but got %v", expectedBody, wrapperBody)
+	}
+
+	for i, expected := range expectedBody {
+		if !wrapperBody[i].Equal(expected) {
+			t.Errorf("Command %v of wrapper body: expected %v but got %v", i, expected, wrapperBody[i])
+		}
+	}
+
+	if len(parser.pendingCommands) != 0 {
+		t.Errorf("Expected no pending commands to have leaked out of the def body, but got %v", parser.pendingCommands)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// ConfigCommandParser is implemented by parsers which produce a stream of
+// ConfigCommands from a config file, regardless of the underlying format
+type ConfigCommandParser interface {
+	Parse() (command ConfigCommand, eof bool, err error)
+	InputSource() string
+}
+
+// IsTomlConfigFile returns true if the provided file path has a file
+// extension associated with the TOML config format
+func IsTomlConfigFile(configFilePath string) bool {
+	return strings.EqualFold(filepath.Ext(configFilePath), ".toml")
+}
+
+// NewConfigCommandParser returns a ConfigCommandParser suitable for the
+// provided input source. The grvrc format is parsed unless inputSource
+// has a ".toml" extension, in which case the TOML format is used
+func NewConfigCommandParser(reader io.Reader, inputSource string) ConfigCommandParser {
+	if IsTomlConfigFile(inputSource) {
+		return NewTomlConfigParser(reader, inputSource)
+	}
+
+	return NewConfigParser(reader, inputSource)
+}
+
+// tomlThemeComponent represents the colors for a single component of a
+// theme. A theme is made up of many of these, read from a
+// [[theme.<name>]] array of tables, so that every component grv supports
+// (commit author, date, diff colors, etc.) can be set
+type tomlThemeComponent struct {
+	Component string `toml:"component"`
+	BgColor   string `toml:"bgcolor"`
+	FgColor   string `toml:"fgcolor"`
+}
+
+// tomlMapEntry represents a single [[map]] table entry
+type tomlMapEntry struct {
+	View string `toml:"view"`
+	From string `toml:"from"`
+	To   string `toml:"to"`
+}
+
+// tomlDocument mirrors the structure of a TOML grvrc file
+type tomlDocument struct {
+	Set   map[string]string               `toml:"set"`
+	Theme map[string][]tomlThemeComponent `toml:"theme"`
+	Map   []tomlMapEntry                  `toml:"map"`
+	Quit  bool                            `toml:"quit"`
+}
+
+// TomlConfigParser is a ConfigCommandParser which reads a grvrc written
+// using the TOML format and produces the same ConfigCommand stream as
+// ConfigParser
+type TomlConfigParser struct {
+	inputSource string
+	commands    []ConfigCommand
+	index       int
+	err         error
+}
+
+// NewTomlConfigParser creates a new TomlConfigParser which will read
+// input from the provided reader
+func NewTomlConfigParser(reader io.Reader, inputSource string) *TomlConfigParser {
+	parser := &TomlConfigParser{
+		inputSource: inputSource,
+	}
+
+	var document tomlDocument
+	if _, err := toml.DecodeReader(reader, &document); err != nil {
+		parser.err = fmt.Errorf("%v: %v", inputSource, err)
+		return parser
+	}
+
+	parser.commands = tomlDocumentCommands(document)
+
+	return parser
+}
+
+// Parse returns the next command from the input stream
+// eof is set to true if the end of the input stream has been reached
+func (parser *TomlConfigParser) Parse() (command ConfigCommand, eof bool, err error) {
+	if parser.err != nil {
+		err = parser.err
+		parser.err = nil
+		return
+	}
+
+	if parser.index >= len(parser.commands) {
+		eof = true
+		return
+	}
+
+	command = parser.commands[parser.index]
+	parser.index++
+
+	return
+}
+
+// InputSource returns the text description of the input source
+func (parser *TomlConfigParser) InputSource() string {
+	return parser.inputSource
+}
+
+func tomlDocumentCommands(document tomlDocument) (commands []ConfigCommand) {
+	for _, variable := range sortedKeys(document.Set) {
+		commands = append(commands, &SetCommand{
+			variable: newConfigWordToken(variable),
+			value:    newConfigWordToken(document.Set[variable]),
+		})
+	}
+
+	for _, name := range sortedThemeKeys(document.Theme) {
+		for _, component := range document.Theme[name] {
+			commands = append(commands, &ThemeCommand{
+				name:      newConfigWordToken(name),
+				component: newConfigWordToken(component.Component),
+				bgcolor:   newConfigWordToken(component.BgColor),
+				fgcolor:   newConfigWordToken(component.FgColor),
+			})
+		}
+	}
+
+	for _, mapEntry := range document.Map {
+		commands = append(commands, &MapCommand{
+			view: newConfigWordToken(mapEntry.View),
+			from: newConfigWordToken(mapEntry.From),
+			to:   newConfigWordToken(mapEntry.To),
+		})
+	}
+
+	if document.Quit {
+		commands = append(commands, &QuitCommand{})
+	}
+
+	return
+}
+
+func newConfigWordToken(value string) *ConfigToken {
+	return &ConfigToken{
+		tokenType: CtkWord,
+		value:     value,
+	}
+}
+
+// sortedKeys returns the keys of a string-keyed map in sorted order, so
+// that commands generated from TOML maps have a stable, repeatable order
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+func sortedThemeKeys(themes map[string][]tomlThemeComponent) []string {
+	keys := make([]string, 0, len(themes))
+	for key := range themes {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}